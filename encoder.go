@@ -0,0 +1,115 @@
+package main
+
+import "fmt"
+
+// Encoder abstracts over the different codec/hwaccel combinations markut
+// can cut and concat chunks with. "copy" is the original stream-copy
+// behavior; the rest re-encode, trading speed for compatibility with
+// sources that have a broken GOP structure (long-GOP webcam captures,
+// screen recordings) where -c copy produces unwatchable output.
+type Encoder struct {
+	Name string
+}
+
+var encoders = map[string]Encoder{
+	"copy":              {Name: "copy"},
+	"libx264":           {Name: "libx264"},
+	"h264_vaapi":        {Name: "h264_vaapi"},
+	"h264_nvenc":        {Name: "h264_nvenc"},
+	"hevc_videotoolbox": {Name: "hevc_videotoolbox"},
+	"av1_svt":           {Name: "av1_svt"},
+}
+
+func parseEncoder(name string) (Encoder, error) {
+	if name == "" {
+		name = "copy"
+	}
+
+	encoder, ok := encoders[name]
+	if !ok {
+		return Encoder{}, fmt.Errorf("%s is not a supported -encoder. Expected copy, libx264, h264_vaapi, h264_nvenc, hevc_videotoolbox or av1_svt", name)
+	}
+	return encoder, nil
+}
+
+// containerCodecs lists which encoders are legal muxed into which
+// container.
+var containerCodecs = map[string][]string{
+	"mp4":  {"copy", "libx264", "h264_vaapi", "h264_nvenc", "hevc_videotoolbox"},
+	"mkv":  {"copy", "libx264", "h264_vaapi", "h264_nvenc", "hevc_videotoolbox", "av1_svt"},
+	"webm": {"av1_svt"},
+}
+
+func (e Encoder) ValidateContainer(container string) error {
+	allowed, ok := containerCodecs[container]
+	if !ok {
+		return fmt.Errorf("%s is not a supported -container. Expected mp4, mkv or webm", container)
+	}
+
+	for _, name := range allowed {
+		if name == e.Name {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s cannot be muxed into a %s container", e.Name, container)
+}
+
+// codecName returns the actual ffmpeg -c:v value for the encoder. This
+// differs from e.Name for av1_svt, whose public selector doesn't match
+// ffmpeg's own encoder name (libsvtav1).
+func (e Encoder) codecName() string {
+	if e.Name == "av1_svt" {
+		return "libsvtav1"
+	}
+	return e.Name
+}
+
+// InputArgs returns the ffmpeg args that must appear before -i to set up
+// the encoder's hwaccel, if any.
+func (e Encoder) InputArgs() []string {
+	switch e.Name {
+	case "h264_vaapi":
+		return []string{"-vaapi_device", "/dev/dri/renderD128"}
+	case "h264_nvenc":
+		return []string{"-hwaccel", "cuda", "-hwaccel_output_format", "cuda"}
+	case "hevc_videotoolbox":
+		return []string{"-hwaccel", "videotoolbox"}
+	default:
+		return nil
+	}
+}
+
+// OutputArgs returns the ffmpeg args that select and configure the video
+// (and, when re-encoding, audio) codec. crf, preset and bitrate are only
+// applied when set and when the encoder isn't "copy".
+func (e Encoder) OutputArgs(crf string, preset string, bitrate string) []string {
+	if e.Name == "copy" {
+		return []string{"-c", "copy"}
+	}
+
+	args := []string{}
+
+	if e.Name == "h264_vaapi" {
+		args = append(args, "-vf", "format=nv12,hwupload")
+	}
+
+	args = append(args, "-c:v", e.codecName())
+	if crf != "" {
+		args = append(args, "-crf", crf)
+	}
+	if preset != "" {
+		args = append(args, "-preset", preset)
+	}
+	if bitrate != "" {
+		args = append(args, "-b:v", bitrate)
+	}
+
+	if e.Name == "av1_svt" {
+		args = append(args, "-c:a", "libopus")
+	} else {
+		args = append(args, "-c:a", "aac")
+	}
+
+	return args
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MarkerReader parses a marker file of some format into the ordered list of
+// Chunks it describes. inputPath is the video the markers apply to; formats
+// whose last marker is implicit (e.g. YouTube chapters) need it to look up
+// the input's total duration via ffprobe.
+type MarkerReader interface {
+	ReadChunks(path string, delay int, inputPath string) []Chunk
+}
+
+func selectMarkerReader(format string) (MarkerReader, error) {
+	switch format {
+	case "", "csv":
+		return csvMarkerReader{}, nil
+	case "youtube":
+		return youtubeMarkerReader{}, nil
+	case "edl":
+		return edlMarkerReader{}, nil
+	case "ffmetadata":
+		return ffmetadataMarkerReader{}, nil
+	case "fcpxml":
+		return fcpxmlMarkerReader{}, nil
+	default:
+		return nil, fmt.Errorf("%s is not a supported -format. Expected csv, youtube, edl, ffmetadata or fcpxml", format)
+	}
+}
+
+// slugifyChunkName turns an arbitrary chapter/clip title into a filesystem
+// friendly chunk file name, e.g. "Q&A" -> "qa.mp4".
+func slugifyChunkName(name string, index int) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+
+	if b.Len() == 0 {
+		return fmt.Sprintf("chunk-%02d.mp4", index)
+	}
+
+	return b.String() + ".mp4"
+}
+
+// csvMarkerReader is the original two-column CSV format: timestamp in
+// seconds, optionally followed by "ignore".
+type csvMarkerReader struct{}
+
+func (csvMarkerReader) ReadChunks(path string, delay int, inputPath string) []Chunk {
+	return loadCSVChunks(path, delay)
+}
+
+var youtubeLineRe = regexp.MustCompile(`^\s*(\d{1,2}(?::\d{2}){1,2})\s+(.+?)\s*$`)
+
+// youtubeMarkerReader parses chapter lines pasted out of a YouTube
+// description, e.g. "0:00 Intro" or "1:23:45 Q&A".
+type youtubeMarkerReader struct{}
+
+func (youtubeMarkerReader) ReadChunks(path string, delay int, inputPath string) []Chunk {
+	f, err := os.Open(path)
+	panic_if_err(err)
+	defer f.Close()
+
+	type marker struct {
+		timestamp int
+		name      string
+	}
+	var markers []marker
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		match := youtubeLineRe.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		markers = append(markers, marker{
+			timestamp: flexTsToSecs(match[1]) + delay,
+			name:      match[2],
+		})
+	}
+
+	if len(markers) == 0 {
+		return nil
+	}
+
+	var chunks []Chunk
+	for i, m := range markers {
+		end := 0
+		if i+1 < len(markers) {
+			end = markers[i+1].timestamp
+		} else {
+			end = ffprobeDurationSecs(inputPath) + delay
+		}
+
+		chunks = append(chunks, Chunk{
+			Start: m.timestamp,
+			End:   end,
+			Name:  slugifyChunkName(m.name, i),
+		})
+	}
+
+	return chunks
+}
+
+// flexTsToSecs parses "MM:SS" or "HH:MM:SS" into seconds, unlike tsToSecs
+// which only accepts the 3-component form.
+func flexTsToSecs(ts string) int {
+	comps := strings.Split(ts, ":")
+
+	var hh, mm, ss int
+	var err error
+	switch len(comps) {
+	case 2:
+		mm, err = strconv.Atoi(comps[0])
+		panic_if_err(err)
+		ss, err = strconv.Atoi(comps[1])
+		panic_if_err(err)
+	case 3:
+		hh, err = strconv.Atoi(comps[0])
+		panic_if_err(err)
+		mm, err = strconv.Atoi(comps[1])
+		panic_if_err(err)
+		ss, err = strconv.Atoi(comps[2])
+		panic_if_err(err)
+	default:
+		panic(fmt.Sprintf("%s is not a valid timestamp", ts))
+	}
+
+	return 60*60*hh + 60*mm + ss
+}
+
+var edlRecordRe = regexp.MustCompile(`(\d{2}:\d{2}:\d{2})[:;]\d{2}\s+(\d{2}:\d{2}:\d{2})[:;]\d{2}\s*$`)
+var edlClipNameRe = regexp.MustCompile(`(?i)^\*\s*FROM CLIP NAME:\s*(.+?)\s*$`)
+
+// edlMarkerReader parses CMX3600 Edit Decision Lists: the record-in/out
+// timecodes of each event become a chunk's start/end, and an optional
+// "FROM CLIP NAME" comment on the following line becomes its name.
+type edlMarkerReader struct{}
+
+func (edlMarkerReader) ReadChunks(path string, delay int, inputPath string) []Chunk {
+	f, err := os.Open(path)
+	panic_if_err(err)
+	defer f.Close()
+
+	var chunks []Chunk
+	index := 0
+
+	scanner := bufio.NewScanner(f)
+	var pendingName string
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if match := edlClipNameRe.FindStringSubmatch(line); match != nil {
+			pendingName = match[1]
+			continue
+		}
+
+		match := edlRecordRe.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		start := flexTsToSecs(match[1]) + delay
+		end := flexTsToSecs(match[2]) + delay
+
+		name := pendingName
+		pendingName = ""
+
+		chunkName := fmt.Sprintf("chunk-%02d.mp4", index)
+		if name != "" {
+			chunkName = slugifyChunkName(name, index)
+		}
+
+		chunks = append(chunks, Chunk{
+			Start: start,
+			End:   end,
+			Name:  chunkName,
+		})
+		index++
+	}
+
+	return chunks
+}
+
+var ffmetadataChapterRe = regexp.MustCompile(`^\[CHAPTER\]\s*$`)
+var ffmetadataKVRe = regexp.MustCompile(`^([A-Za-z_]+)=(.*)$`)
+
+// ffmetadataMarkerReader parses the [CHAPTER] blocks that
+// `ffmpeg -f ffmetadata` emits.
+type ffmetadataMarkerReader struct{}
+
+func (ffmetadataMarkerReader) ReadChunks(path string, delay int, inputPath string) []Chunk {
+	f, err := os.Open(path)
+	panic_if_err(err)
+	defer f.Close()
+
+	var chunks []Chunk
+	index := 0
+
+	inChapter := false
+	timebaseNum, timebaseDen := 1, 1000
+	var startTicks, endTicks int64
+	var title string
+
+	flush := func() {
+		if !inChapter {
+			return
+		}
+		start := int(startTicks*int64(timebaseNum)/int64(timebaseDen)) + delay
+		end := int(endTicks*int64(timebaseNum)/int64(timebaseDen)) + delay
+		chunkName := fmt.Sprintf("chunk-%02d.mp4", index)
+		if title != "" {
+			chunkName = slugifyChunkName(title, index)
+		}
+		chunks = append(chunks, Chunk{Start: start, End: end, Name: chunkName})
+		index++
+		title = ""
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if ffmetadataChapterRe.MatchString(line) {
+			flush()
+			inChapter = true
+			continue
+		}
+
+		if !inChapter {
+			continue
+		}
+
+		match := ffmetadataKVRe.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		key, value := match[1], match[2]
+		switch key {
+		case "TIMEBASE":
+			comps := strings.SplitN(value, "/", 2)
+			if len(comps) == 2 {
+				timebaseNum, _ = strconv.Atoi(comps[0])
+				timebaseDen, _ = strconv.Atoi(comps[1])
+			}
+		case "START":
+			startTicks, _ = strconv.ParseInt(value, 10, 64)
+		case "END":
+			endTicks, _ = strconv.ParseInt(value, 10, 64)
+		case "title":
+			title = value
+		}
+	}
+	flush()
+
+	return chunks
+}
+
+// fcpxmlSpine is the minimal subset of a Final Cut Pro XML timeline we
+// understand: a sequence of clips on the primary spine.
+type fcpxmlSpine struct {
+	Clips []fcpxmlClip `xml:"asset-clip"`
+}
+
+type fcpxmlClip struct {
+	Name     string `xml:"name,attr"`
+	Offset   string `xml:"offset,attr"`
+	Duration string `xml:"duration,attr"`
+}
+
+type fcpxmlProject struct {
+	Spine fcpxmlSpine `xml:"library>event>project>sequence>spine"`
+}
+
+// fcpxmlMarkerReader parses <asset-clip> elements off a FCPXML timeline's
+// primary spine.
+type fcpxmlMarkerReader struct{}
+
+func (fcpxmlMarkerReader) ReadChunks(path string, delay int, inputPath string) []Chunk {
+	f, err := os.Open(path)
+	panic_if_err(err)
+	defer f.Close()
+
+	var project fcpxmlProject
+	panic_if_err(xml.NewDecoder(f).Decode(&project))
+
+	var chunks []Chunk
+	for i, clip := range project.Spine.Clips {
+		offset := fcpxmlTimeToSecs(clip.Offset)
+		duration := fcpxmlTimeToSecs(clip.Duration)
+
+		chunks = append(chunks, Chunk{
+			Start: offset + delay,
+			End:   offset + duration + delay,
+			Name:  slugifyChunkName(clip.Name, i),
+		})
+	}
+
+	return chunks
+}
+
+// writeFFMetadataChapters writes an `ffmpeg -f ffmetadata` chapters file out
+// of chunks, one [CHAPTER] block per chunk, titled after its Name.
+func writeFFMetadataChapters(chunks []Chunk, outputPath string) error {
+	f, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, ";FFMETADATA1\n")
+
+	secs := 0
+	for _, chunk := range chunks {
+		duration := chunk.Duration(chunk.End)
+		title := strings.TrimSuffix(chunk.Name, ".mp4")
+
+		fmt.Fprintf(f, "[CHAPTER]\n")
+		fmt.Fprintf(f, "TIMEBASE=1/1000\n")
+		fmt.Fprintf(f, "START=%d\n", secs*1000)
+		fmt.Fprintf(f, "END=%d\n", (secs+duration)*1000)
+		fmt.Fprintf(f, "title=%s\n", title)
+
+		secs += duration
+	}
+
+	return nil
+}
+
+// ffmpegMuxChapters remuxes videoPath with chapter metadata from
+// metadataPath, via a second ffmpeg pass, so players that support chapters
+// get clickable chapter markers. The temp file keeps videoPath's own
+// extension so ffmpeg muxes it into the right container (-codec copy
+// can't transcode mkv/webm into an mp4 wrapper, or vice versa).
+func ffmpegMuxChapters(videoPath string, metadataPath string, y bool) error {
+	ext := filepath.Ext(videoPath)
+	tmpPath := strings.TrimSuffix(videoPath, ext) + ".chapters" + ext
+
+	args := []string{}
+	if y {
+		args = append(args, "-y")
+	}
+	args = append(args, "-i", videoPath, "-i", metadataPath)
+	args = append(args, "-map_metadata", "1")
+	args = append(args, "-codec", "copy")
+	args = append(args, tmpPath)
+
+	if err := ffmpegRun(args); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, videoPath)
+}
+
+// fcpxmlTimeToSecs parses FCPXML's rational time format, "<num>/<den>s" or
+// just "<num>s".
+func fcpxmlTimeToSecs(s string) int {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "s")
+	if s == "" {
+		return 0
+	}
+
+	comps := strings.SplitN(s, "/", 2)
+	if len(comps) == 1 {
+		n, err := strconv.Atoi(comps[0])
+		panic_if_err(err)
+		return n
+	}
+
+	num, err := strconv.Atoi(comps[0])
+	panic_if_err(err)
+	den, err := strconv.Atoi(comps[1])
+	panic_if_err(err)
+	if den == 0 {
+		return 0
+	}
+	return num / den
+}
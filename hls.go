@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// HLSVariant is one rung of an ABR ladder: a vertical resolution and a
+// target video bitrate to re-encode the segments at.
+type HLSVariant struct {
+	Name    string
+	Height  int
+	Bitrate string
+}
+
+// parseVariants parses "-variants" strings like
+// "1080p:5M,720p:2.8M,480p:1.4M" into a list of HLSVariant.
+func parseVariants(s string) ([]HLSVariant, error) {
+	var variants []HLSVariant
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		comps := strings.SplitN(entry, ":", 2)
+		if len(comps) != 2 {
+			return nil, fmt.Errorf("%s is not a valid variant. Expected NAMEp:BITRATE", entry)
+		}
+
+		name := strings.TrimSpace(comps[0])
+		bitrate := strings.TrimSpace(comps[1])
+
+		height, err := strconv.Atoi(strings.TrimSuffix(name, "p"))
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid variant height", name)
+		}
+
+		variants = append(variants, HLSVariant{
+			Name:    name,
+			Height:  height,
+			Bitrate: bitrate,
+		})
+	}
+
+	return variants, nil
+}
+
+func segmentName(chunk Chunk, variant string) string {
+	base := strings.TrimSuffix(chunk.Name, ".mp4")
+	if variant == "" {
+		return base + ".ts"
+	}
+	return fmt.Sprintf("%s.%s.ts", base, variant)
+}
+
+// ffmpegRemuxToSegment turns an already-cut chunk into an HLS segment,
+// optionally scaling it down and re-encoding it for a specific ABR variant.
+func ffmpegRemuxToSegment(chunk Chunk, variant *HLSVariant, y bool) error {
+	args := []string{}
+
+	if y {
+		args = append(args, "-y")
+	}
+
+	args = append(args, "-i", chunk.Name)
+
+	if variant == nil {
+		args = append(args, "-c", "copy")
+	} else {
+		args = append(args, "-vf", fmt.Sprintf("scale=-2:%d", variant.Height))
+		args = append(args, "-c:v", "libx264", "-b:v", variant.Bitrate)
+		args = append(args, "-c:a", "aac")
+	}
+
+	args = append(args, "-bsf:v", "h264_mp4toannexb")
+	args = append(args, "-f", "mpegts")
+
+	name := ""
+	if variant == nil {
+		name = segmentName(chunk, "")
+	} else {
+		name = segmentName(chunk, variant.Name)
+	}
+	args = append(args, name)
+
+	return ffmpegRun(args)
+}
+
+// generateMediaPlaylist writes an HLS media playlist where every Chunk
+// becomes exactly one #EXTINF segment.
+func generateMediaPlaylist(chunks []Chunk, variant string, outputPath string) error {
+	f, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	targetDuration := 0
+	for _, chunk := range chunks {
+		if d := chunk.Duration(chunk.End); d > targetDuration {
+			targetDuration = d
+		}
+	}
+
+	fmt.Fprintf(f, "#EXTM3U\n")
+	fmt.Fprintf(f, "#EXT-X-VERSION:3\n")
+	fmt.Fprintf(f, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	fmt.Fprintf(f, "#EXT-X-PLAYLIST-TYPE:VOD\n")
+
+	for _, chunk := range chunks {
+		fmt.Fprintf(f, "#EXTINF:%d,%s\n", chunk.Duration(chunk.End), chunk.Name)
+		fmt.Fprintf(f, "%s\n", segmentName(chunk, variant))
+	}
+
+	fmt.Fprintf(f, "#EXT-X-ENDLIST\n")
+	return nil
+}
+
+// generateMasterPlaylist writes an HLS master playlist referencing one
+// media playlist per ABR variant.
+func generateMasterPlaylist(variants []HLSVariant, outputPath string) error {
+	f, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "#EXTM3U\n")
+	fmt.Fprintf(f, "#EXT-X-VERSION:3\n")
+
+	for _, variant := range variants {
+		bandwidth := bitrateToBandwidth(variant.Bitrate)
+		// RESOLUTION is omitted: variants are scaled with "scale=-2:height",
+		// so the actual width depends on the source's aspect ratio, which
+		// markut doesn't probe. RESOLUTION=WIDTHxHEIGHT with a guessed width
+		// would be invalid per the HLS spec and rejected by strict players.
+		fmt.Fprintf(f, "#EXT-X-STREAM-INF:BANDWIDTH=%d\n", bandwidth)
+		fmt.Fprintf(f, "%s.m3u8\n", variant.Name)
+	}
+
+	return nil
+}
+
+// bitrateToBandwidth converts an ffmpeg-style bitrate ("5M", "850k") into a
+// plain bits-per-second integer for EXT-X-STREAM-INF.
+func bitrateToBandwidth(bitrate string) int {
+	bitrate = strings.TrimSpace(bitrate)
+	mult := 1
+
+	if strings.HasSuffix(bitrate, "M") {
+		mult = 1000 * 1000
+		bitrate = strings.TrimSuffix(bitrate, "M")
+	} else if strings.HasSuffix(bitrate, "k") || strings.HasSuffix(bitrate, "K") {
+		mult = 1000
+		bitrate = bitrate[:len(bitrate)-1]
+	}
+
+	n, err := strconv.ParseFloat(bitrate, 64)
+	panic_if_err(err)
+	return int(math.Round(n * float64(mult)))
+}
+
+// generateChaptersVTT builds a WebVTT sidecar out of the ignored/cut
+// highlights so the "ignored" and "cut" markers become seekable chapter
+// cues in a web player.
+func generateChaptersVTT(highlights []Highlight, outputPath string) error {
+	f, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "WEBVTT\n\n")
+
+	prev := "00:00:00.000"
+	for i, highlight := range highlights {
+		cur := highlight.timestamp + ".000"
+		fmt.Fprintf(f, "%d\n", i+1)
+		fmt.Fprintf(f, "%s --> %s\n", prev, cur)
+		fmt.Fprintf(f, "%s\n\n", highlight.message)
+		prev = cur
+	}
+
+	return nil
+}
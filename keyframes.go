@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SnapMode controls how a timestamp is rounded to the nearest available keyframe.
+type SnapMode int
+
+const (
+	// SnapAuto floors chunk starts and ceils chunk ends, which is the
+	// right thing to do when cutting out a chunk of a bigger video.
+	SnapAuto SnapMode = iota
+	SnapFloor
+	SnapCeil
+	SnapNearest
+)
+
+func parseSnapMode(s string) (SnapMode, error) {
+	switch s {
+	case "auto":
+		return SnapAuto, nil
+	case "floor":
+		return SnapFloor, nil
+	case "ceil":
+		return SnapCeil, nil
+	case "nearest":
+		return SnapNearest, nil
+	default:
+		return SnapAuto, fmt.Errorf("%s is not a valid snap mode. Expected auto, floor, ceil or nearest", s)
+	}
+}
+
+// keyframeCache memoizes the sorted keyframe timestamps (in whole seconds)
+// per input file so we only shell out to ffprobe once.
+var keyframeCache = map[string][]int{}
+
+// keyframeCacheMu guards keyframeCache. It is held across the ffprobe call,
+// so concurrent callers for the same file wait for the first probe instead
+// of running their own.
+var keyframeCacheMu sync.Mutex
+
+// ffprobeKeyframes returns the keyframe timestamps of inputPath, truncated
+// to whole seconds. This means a snapped Start isn't necessarily an exact
+// keyframe (e.g. a keyframe at 3.5s is reported as 3): -ss on it still
+// re-seeks to whatever real keyframe precedes that second. Snapping is
+// therefore only second-accurate, not frame-accurate.
+func ffprobeKeyframes(inputPath string) ([]int, error) {
+	keyframeCacheMu.Lock()
+	defer keyframeCacheMu.Unlock()
+
+	if keyframes, ok := keyframeCache[inputPath]; ok {
+		return keyframes, nil
+	}
+
+	args := []string{
+		"-select_streams", "v",
+		"-show_frames",
+		"-skip_frame", "nokey",
+		"-show_entries", "frame=pkt_pts_time",
+		"-of", "csv=p=0",
+		inputPath,
+	}
+
+	cmd := exec.Command("ffprobe", args...)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var keyframes []int
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		pts, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			continue
+		}
+		keyframes = append(keyframes, int(pts))
+	}
+
+	sort.Ints(keyframes)
+	keyframeCache[inputPath] = keyframes
+	return keyframes, nil
+}
+
+// ffprobeDurationSecs returns the total duration of inputPath, in whole
+// seconds, as reported by ffprobe. Used by marker formats whose last
+// boundary is implicit (e.g. YouTube chapters, which have no explicit end).
+func ffprobeDurationSecs(inputPath string) int {
+	args := []string{
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "csv=p=0",
+		inputPath,
+	}
+
+	cmd := exec.Command("ffprobe", args...)
+	out, err := cmd.Output()
+	panic_if_err(err)
+
+	secs, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	panic_if_err(err)
+
+	return int(secs)
+}
+
+// SnapToKeyframe returns the keyframe timestamp (in seconds) closest to ts
+// according to mode. If no keyframes are known for inputPath, ts is
+// returned unchanged. Keyframe timestamps are whole-second truncated (see
+// ffprobeKeyframes), so the result is only second-accurate: it won't
+// generally land on the exact keyframe ffmpeg itself seeks to.
+func SnapToKeyframe(inputPath string, ts int, mode SnapMode) int {
+	keyframes, err := ffprobeKeyframes(inputPath)
+	if err != nil || len(keyframes) == 0 {
+		return ts
+	}
+
+	// index of the first keyframe >= ts
+	i := sort.SearchInts(keyframes, ts)
+
+	switch mode {
+	case SnapFloor:
+		if i < len(keyframes) && keyframes[i] == ts {
+			return ts
+		}
+		if i == 0 {
+			return keyframes[0]
+		}
+		return keyframes[i-1]
+	case SnapCeil:
+		// If ts is past the last known keyframe, there's nothing to ceil
+		// to: falling back to the last keyframe would return a value
+		// before ts, silently truncating whatever follows it (e.g. the
+		// final chunk's End, which is usually the end of the video).
+		if i < len(keyframes) {
+			return keyframes[i]
+		}
+		return ts
+	case SnapNearest:
+		if i == 0 {
+			return keyframes[0]
+		}
+		if i >= len(keyframes) {
+			return keyframes[len(keyframes)-1]
+		}
+		before := keyframes[i-1]
+		after := keyframes[i]
+		if ts-before <= after-ts {
+			return before
+		}
+		return after
+	default:
+		return ts
+	}
+}
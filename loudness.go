@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// loudnormMeasurement is the JSON block that
+// `ffmpeg -af loudnorm=...:print_format=json` prints to stderr after its
+// first pass.
+type loudnormMeasurement struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+var loudnormJSONRe = regexp.MustCompile(`(?s)\{.*\}`)
+
+// ffmpegMeasureLoudness runs the loudnorm analysis pass over chunkPath and
+// parses the trailing JSON block out of ffmpeg's stderr.
+func ffmpegMeasureLoudness(chunkPath string, target, tp, lra string) (*loudnormMeasurement, error) {
+	filter := fmt.Sprintf("loudnorm=I=%s:TP=%s:LRA=%s:print_format=json", target, tp, lra)
+	args := []string{"-i", chunkPath, "-af", filter, "-f", "null", "-"}
+
+	cmd := exec.Command("ffmpeg", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	// loudnorm's analysis pass still needs to decode the whole file, we just
+	// throw the output away, so stdout/stdin are left unset.
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg loudnorm analysis failed: %w", err)
+	}
+
+	match := loudnormJSONRe.FindString(stderr.String())
+	if match == "" {
+		return nil, fmt.Errorf("could not find loudnorm JSON output for %s", chunkPath)
+	}
+
+	var measurement loudnormMeasurement
+	if err := json.Unmarshal([]byte(match), &measurement); err != nil {
+		return nil, fmt.Errorf("could not parse loudnorm JSON output for %s: %w", chunkPath, err)
+	}
+
+	return &measurement, nil
+}
+
+// ffmpegApplyLoudnorm runs the second, linear loudnorm pass using the
+// measurement from ffmpegMeasureLoudness and writes a normalized copy of
+// chunkPath to outputPath.
+func ffmpegApplyLoudnorm(chunkPath string, outputPath string, target, tp, lra string, m *loudnormMeasurement, y bool) error {
+	filter := fmt.Sprintf(
+		"loudnorm=I=%s:TP=%s:LRA=%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+		target, tp, lra, m.InputI, m.InputTP, m.InputLRA, m.InputThresh, m.TargetOffset,
+	)
+
+	args := []string{}
+	if y {
+		args = append(args, "-y")
+	}
+	args = append(args, "-i", chunkPath)
+	args = append(args, "-af", filter)
+	args = append(args, "-c:v", "copy", "-c:a", "aac", "-b:a", "192k")
+	args = append(args, outputPath)
+
+	return ffmpegRun(args)
+}
+
+// ffmpegNormalizeChunkLoudnorm runs the full two-pass EBU R128 loudness
+// normalization over chunkPath and returns the path of the normalized file.
+func ffmpegNormalizeChunkLoudnorm(chunkPath string, target, tp, lra string, y bool) (string, error) {
+	measurement, err := ffmpegMeasureLoudness(chunkPath, target, tp, lra)
+	if err != nil {
+		return "", err
+	}
+
+	outputPath := strings.TrimSuffix(chunkPath, ".mp4") + ".norm.mp4"
+	if err := ffmpegApplyLoudnorm(chunkPath, outputPath, target, tp, lra, measurement, y); err != nil {
+		return "", err
+	}
+
+	return outputPath, nil
+}
+
+var volumeDetectRe = regexp.MustCompile(`max_volume:\s*(-?[0-9.]+)\s*dB`)
+
+// ffmpegNormalizeChunkPeak runs a single volumedetect pass over chunkPath
+// and applies a flat -af volume=<gain>dB so that its peak lands at 0dB, for
+// users who want cheap peak normalization without the two-pass loudnorm
+// cost.
+func ffmpegNormalizeChunkPeak(chunkPath string, y bool) (string, error) {
+	args := []string{"-i", chunkPath, "-af", "volumedetect", "-f", "null", "-"}
+
+	cmd := exec.Command("ffmpeg", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("ffmpeg volumedetect failed: %w", err)
+	}
+
+	match := volumeDetectRe.FindStringSubmatch(stderr.String())
+	if match == nil {
+		return "", fmt.Errorf("could not find max_volume output for %s", chunkPath)
+	}
+
+	outputPath := strings.TrimSuffix(chunkPath, ".mp4") + ".norm.mp4"
+	gainArgs := []string{}
+	if y {
+		gainArgs = append(gainArgs, "-y")
+	}
+	gainArgs = append(gainArgs, "-i", chunkPath)
+	gainArgs = append(gainArgs, "-af", fmt.Sprintf("volume=%sdB", negate(match[1])))
+	gainArgs = append(gainArgs, "-c:v", "copy", "-c:a", "aac", "-b:a", "192k")
+	gainArgs = append(gainArgs, outputPath)
+
+	if err := ffmpegRun(gainArgs); err != nil {
+		return "", err
+	}
+
+	return outputPath, nil
+}
+
+// negate flips the sign of a decimal string, e.g. "-6.2" -> "6.2".
+func negate(s string) string {
+	if strings.HasPrefix(s, "-") {
+		return strings.TrimPrefix(s, "-")
+	}
+	return "-" + s
+}
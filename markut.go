@@ -47,6 +47,23 @@ type Chunk struct {
 	Name    string
 }
 
+// snapChunks snaps the Start/End of every chunk to a keyframe of inputPath,
+// according to mode. SnapAuto (the default) floors Start and ceils End so a
+// chunk never loses decodable frames off either edge; the other modes apply
+// uniformly to both ends.
+func snapChunks(chunks []Chunk, inputPath string, mode SnapMode) []Chunk {
+	startMode, endMode := mode, mode
+	if mode == SnapAuto {
+		startMode, endMode = SnapFloor, SnapCeil
+	}
+
+	for i := range chunks {
+		chunks[i].Start = SnapToKeyframe(inputPath, chunks[i].Start, startMode)
+		chunks[i].End = SnapToKeyframe(inputPath, chunks[i].End, endMode)
+	}
+	return chunks
+}
+
 func (chunk Chunk) Duration(end int) int {
 	if end < chunk.Start {
 		panic("Assertion Failed: Incorrect end")
@@ -54,7 +71,25 @@ func (chunk Chunk) Duration(end int) int {
 	return end - chunk.Start
 }
 
-func loadChunksFromFile(path string, delay int) []Chunk {
+// retargetChunkExt renames every chunk's file extension to ext (without the
+// leading dot). Marker readers always name chunks "....mp4"; final is the
+// only subcommand that lets -container pick something else, and the cut
+// chunks must actually be named into that container or the concat/mux chain
+// downstream never touches the chosen container at all.
+func retargetChunkExt(chunks []Chunk, ext string) []Chunk {
+	for i := range chunks {
+		chunks[i].Name = strings.TrimSuffix(chunks[i].Name, ".mp4") + "." + ext
+	}
+	return chunks
+}
+
+func loadChunksFromFile(path string, delay int, format string, inputPath string) []Chunk {
+	reader, err := selectMarkerReader(format)
+	panic_if_err(err)
+	return reader.ReadChunks(path, delay, inputPath)
+}
+
+func loadCSVChunks(path string, delay int) []Chunk {
 	f, err := os.Open(path)
 	panic_if_err(err)
 	defer f.Close()
@@ -108,26 +143,114 @@ func loadChunksFromFile(path string, delay int) []Chunk {
 	return chunks
 }
 
-func ffmpegCutChunk(inputPath string, chunk Chunk, y bool) error {
+func ffmpegRun(args []string) error {
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func ffmpegCutChunkCopy(inputPath string, start int, duration int, y bool, outputPath string, encoder Encoder, crf string, preset string, bitrate string) error {
 	args := []string{}
 
 	if y {
 		args = append(args, "-y")
 	}
 
-	args = append(args, "-ss", strconv.Itoa(chunk.Start))
+	args = append(args, encoder.InputArgs()...)
+	args = append(args, "-ss", strconv.Itoa(start))
 	args = append(args, "-i", inputPath)
-	args = append(args, "-c", "copy")
-	args = append(args, "-t", strconv.Itoa(chunk.Duration(chunk.End)))
-	args = append(args, chunk.Name)
+	args = append(args, encoder.OutputArgs(crf, preset, bitrate)...)
+	args = append(args, "-t", strconv.Itoa(duration))
+	args = append(args, outputPath)
 
-	cmd := exec.Command("ffmpeg", args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return ffmpegRun(args)
+}
+
+// ffmpegCutChunkHybrid handles a Start that doesn't land on a keyframe: it
+// re-encodes the short span from Start up to the next keyframe, stream-copies
+// the rest from that keyframe onward, and stitches the two together with the
+// concat demuxer, the same trick HLS transcoders use to keep segments
+// boundary-aligned. nextKeyframe is the first keyframe at or after
+// chunk.Start. The lead-in is re-encoded with encoder (falling back to
+// libx264/aac when encoder is "copy", since copy can't produce it).
+func ffmpegCutChunkHybrid(inputPath string, chunk Chunk, nextKeyframe int, y bool, encoder Encoder, crf string, preset string, bitrate string) error {
+	leadEncoder := encoder
+	if leadEncoder.Name == "copy" {
+		leadEncoder = Encoder{Name: "libx264"}
+	}
+
+	if nextKeyframe >= chunk.End {
+		args := []string{}
+		if y {
+			args = append(args, "-y")
+		}
+		args = append(args, leadEncoder.InputArgs()...)
+		args = append(args, "-ss", strconv.Itoa(chunk.Start))
+		args = append(args, "-i", inputPath)
+		args = append(args, "-t", strconv.Itoa(chunk.Duration(chunk.End)))
+		args = append(args, leadEncoder.OutputArgs(crf, preset, bitrate)...)
+		args = append(args, chunk.Name)
+		return ffmpegRun(args)
+	}
+
+	leadPath := chunk.Name + ".lead.mp4"
+	tailPath := chunk.Name + ".tail.mp4"
+	listPath := chunk.Name + ".concat.txt"
+	defer os.Remove(leadPath)
+	defer os.Remove(tailPath)
+	defer os.Remove(listPath)
+
+	leadArgs := []string{}
+	if y {
+		leadArgs = append(leadArgs, "-y")
+	}
+	leadArgs = append(leadArgs, leadEncoder.InputArgs()...)
+	leadArgs = append(leadArgs, "-ss", strconv.Itoa(chunk.Start))
+	leadArgs = append(leadArgs, "-i", inputPath)
+	leadArgs = append(leadArgs, "-t", strconv.Itoa(nextKeyframe-chunk.Start))
+	leadArgs = append(leadArgs, leadEncoder.OutputArgs(crf, preset, bitrate)...)
+	leadArgs = append(leadArgs, leadPath)
+	if err := ffmpegRun(leadArgs); err != nil {
+		return err
+	}
+
+	if err := ffmpegCutChunkCopy(inputPath, nextKeyframe, chunk.End-nextKeyframe, y, tailPath, Encoder{Name: "copy"}, "", "", ""); err != nil {
+		return err
+	}
+
+	f, err := os.Create(listPath)
+	panic_if_err(err)
+	fmt.Fprintf(f, "file '%s'\n", leadPath)
+	fmt.Fprintf(f, "file '%s'\n", tailPath)
+	f.Close()
+
+	concatArgs := []string{}
+	if y {
+		concatArgs = append(concatArgs, "-y")
+	}
+	concatArgs = append(concatArgs, "-f", "concat", "-safe", "0", "-i", listPath)
+	concatArgs = append(concatArgs, "-c", "copy")
+	concatArgs = append(concatArgs, chunk.Name)
+	return ffmpegRun(concatArgs)
 }
 
+func ffmpegCutChunk(inputPath string, chunk Chunk, y bool, reencode bool, encoder Encoder, crf string, preset string, bitrate string) error {
+	if reencode {
+		nextKeyframe := SnapToKeyframe(inputPath, chunk.Start, SnapCeil)
+		if nextKeyframe != chunk.Start {
+			return ffmpegCutChunkHybrid(inputPath, chunk, nextKeyframe, y, encoder, crf, preset, bitrate)
+		}
+	}
+
+	return ffmpegCutChunkCopy(inputPath, chunk.Start, chunk.Duration(chunk.End), y, chunk.Name, encoder, crf, preset, bitrate)
+}
+
+// ffmpegConcatChunks stitches already-cut chunks together. It always
+// stream-copies: whatever encoder cut the chunks already left them in the
+// target codec, so re-encoding here would only cost a generation of quality
+// and double the render time.
 func ffmpegConcatChunks(listPath string, outputPath string, y bool) {
 	args := []string{}
 
@@ -165,6 +288,7 @@ func usage() {
 	fmt.Printf("    final      Render the final video\n")
 	fmt.Printf("    chunk      Render specific chunk of the final video\n")
 	fmt.Printf("    inspect    Inspect markers in the CSV file\n")
+	fmt.Printf("    stream     Render an HLS stream instead of a single output.mp4\n")
 }
 
 func subUsage(subName string, subFlag *flag.FlagSet) {
@@ -207,6 +331,20 @@ func finalSubcommand(args []string) {
 	inputPtr := finalFlag.String("input", "", "Path to the input video file")
 	delayPtr := finalFlag.Int("delay", 0, "Delay of markers in seconds")
 	yPtr := finalFlag.Bool("y", false, "Pass -y to ffmpeg")
+	snapPtr := finalFlag.String("snap", "auto", "Keyframe snapping policy: auto, floor, ceil or nearest")
+	reencodePtr := finalFlag.Bool("reencode", false, "Re-encode the pre-keyframe lead-in of misaligned chunks instead of snapping them")
+	loudnormPtr := finalFlag.Bool("loudnorm", false, "Two-pass EBU R128 loudness normalization between cut and concat")
+	peakPtr := finalFlag.Bool("peak", false, "Single-pass peak normalization instead of -loudnorm")
+	loudnessTargetPtr := finalFlag.String("loudness-target", "-16", "loudnorm integrated loudness target (I)")
+	loudnessTpPtr := finalFlag.String("loudness-tp", "-1.5", "loudnorm true peak target (TP)")
+	loudnessLraPtr := finalFlag.String("loudness-lra", "11", "loudnorm loudness range target (LRA)")
+	jPtr := finalFlag.Int("j", defaultWorkerCount(), "Number of chunks to cut in parallel")
+	formatPtr := finalFlag.String("format", "csv", "Marker file format: csv, youtube, edl, ffmetadata or fcpxml")
+	encoderPtr := finalFlag.String("encoder", "copy", "Encoder: copy, libx264, h264_vaapi, h264_nvenc, hevc_videotoolbox or av1_svt")
+	crfPtr := finalFlag.String("crf", "", "Constant rate factor, when re-encoding")
+	presetPtr := finalFlag.String("preset", "", "Encoder preset, when re-encoding")
+	bitratePtr := finalFlag.String("bitrate", "", "Target video bitrate, when re-encoding")
+	containerPtr := finalFlag.String("container", "mp4", "Output container: mp4, mkv or webm")
 
 	finalFlag.Parse(args)
 
@@ -222,17 +360,73 @@ func finalSubcommand(args []string) {
 		os.Exit(1)
 	}
 
-	chunks := loadChunksFromFile(*csvPtr, *delayPtr)
-	for _, chunk := range chunks {
-		err := ffmpegCutChunk(*inputPtr, chunk, *yPtr)
-		if err != nil {
-			fmt.Printf("WARNING: Failed to cut chunk: %s", err)
+	snapMode, err := parseSnapMode(*snapPtr)
+	if err != nil {
+		subUsage("final", finalFlag)
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	encoder, err := parseEncoder(*encoderPtr)
+	if err != nil {
+		subUsage("final", finalFlag)
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	if err := encoder.ValidateContainer(*containerPtr); err != nil {
+		subUsage("final", finalFlag)
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	chunks := loadChunksFromFile(*csvPtr, *delayPtr, *formatPtr, *inputPtr)
+	chunks = retargetChunkExt(chunks, *containerPtr)
+	if !*reencodePtr {
+		chunks = snapChunks(chunks, *inputPtr, snapMode)
+	}
+
+	renderer := NewProgressRenderer(chunks)
+	chunkErrors := cutChunksParallel(*inputPtr, chunks, *yPtr, *reencodePtr, encoder, *crfPtr, *presetPtr, *bitratePtr, *jPtr, renderer)
+	if len(chunkErrors) > 0 {
+		fmt.Println("Some chunks failed to cut:")
+		for _, chunkErr := range chunkErrors {
+			fmt.Printf("  %s: %s\n", chunkErr.Chunk.Name, chunkErr.Err)
+		}
+		os.Exit(1)
+	}
+
+	concatChunks := chunks
+	if *loudnormPtr || *peakPtr {
+		concatChunks = make([]Chunk, len(chunks))
+		copy(concatChunks, chunks)
+		for i, chunk := range concatChunks {
+			var normPath string
+			var err error
+			if *peakPtr {
+				normPath, err = ffmpegNormalizeChunkPeak(chunk.Name, *yPtr)
+			} else {
+				normPath, err = ffmpegNormalizeChunkLoudnorm(chunk.Name, *loudnessTargetPtr, *loudnessTpPtr, *loudnessLraPtr, *yPtr)
+			}
+			if err != nil {
+				fmt.Printf("WARNING: Failed to normalize loudness of %s: %s\n", chunk.Name, err)
+				continue
+			}
+			concatChunks[i].Name = normPath
 		}
 	}
 
+	outputPath := fmt.Sprintf("output.%s", *containerPtr)
+
 	ourlistPath := "ourlist.txt"
-	ffmpegGenerateConcatList(chunks, ourlistPath)
-	ffmpegConcatChunks(ourlistPath, "output.mp4", *yPtr)
+	ffmpegGenerateConcatList(concatChunks, ourlistPath)
+	ffmpegConcatChunks(ourlistPath, outputPath, *yPtr)
+
+	if *formatPtr != "csv" {
+		chaptersPath := "chapters.ffmetadata"
+		panic_if_err(writeFFMetadataChapters(chunks, chaptersPath))
+		panic_if_err(ffmpegMuxChapters(outputPath, chaptersPath, *yPtr))
+	}
 
 	fmt.Println("Highlights:")
 	for _, highlight := range highlightChunks(chunks) {
@@ -247,6 +441,13 @@ func chunkSubcommand(args []string) {
 	delayPtr := chunkFlag.Int("delay", 0, "Delay of markers in seconds")
 	chunkPtr := chunkFlag.Int("chunk", 0, "Chunk number to render")
 	yPtr := chunkFlag.Bool("y", false, "Pass -y to ffmpeg")
+	snapPtr := chunkFlag.String("snap", "auto", "Keyframe snapping policy: auto, floor, ceil or nearest")
+	reencodePtr := chunkFlag.Bool("reencode", false, "Re-encode the pre-keyframe lead-in of misaligned chunks instead of snapping them")
+	formatPtr := chunkFlag.String("format", "csv", "Marker file format: csv, youtube, edl, ffmetadata or fcpxml")
+	encoderPtr := chunkFlag.String("encoder", "copy", "Encoder: copy, libx264, h264_vaapi, h264_nvenc, hevc_videotoolbox or av1_svt")
+	crfPtr := chunkFlag.String("crf", "", "Constant rate factor, when re-encoding")
+	presetPtr := chunkFlag.String("preset", "", "Encoder preset, when re-encoding")
+	bitratePtr := chunkFlag.String("bitrate", "", "Target video bitrate, when re-encoding")
 
 	chunkFlag.Parse(args)
 
@@ -262,16 +463,34 @@ func chunkSubcommand(args []string) {
 		os.Exit(1)
 	}
 
-	chunks := loadChunksFromFile(*csvPtr, *delayPtr)
+	snapMode, err := parseSnapMode(*snapPtr)
+	if err != nil {
+		subUsage("chunk", chunkFlag)
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	encoder, err := parseEncoder(*encoderPtr)
+	if err != nil {
+		subUsage("chunk", chunkFlag)
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	chunks := loadChunksFromFile(*csvPtr, *delayPtr, *formatPtr, *inputPtr)
 
 	if *chunkPtr > len(chunks) {
 		fmt.Printf("ERROR: %d is incorrect chunk number. There is only %d of them.\n", *chunkPtr, len(chunks))
 		os.Exit(1)
 	}
 
+	if !*reencodePtr {
+		chunks = snapChunks(chunks, *inputPtr, snapMode)
+	}
+
 	chunk := chunks[*chunkPtr]
 
-	err := ffmpegCutChunk(*inputPtr, chunk, *yPtr)
+	err = ffmpegCutChunk(*inputPtr, chunk, *yPtr, *reencodePtr, encoder, *crfPtr, *presetPtr, *bitratePtr)
 	panic_if_err(err)
 
 	fmt.Printf("%s is rendered!\n", chunk.Name)
@@ -283,10 +502,81 @@ func chunkSubcommand(args []string) {
 	}
 }
 
+func streamSubcommand(args []string) {
+	streamFlag := flag.NewFlagSet("stream", flag.ExitOnError)
+	csvPtr := streamFlag.String("csv", "", "Path to the CSV file with markers")
+	inputPtr := streamFlag.String("input", "", "Path to the input video file")
+	delayPtr := streamFlag.Int("delay", 0, "Delay of markers in seconds")
+	yPtr := streamFlag.Bool("y", false, "Pass -y to ffmpeg")
+	snapPtr := streamFlag.String("snap", "auto", "Keyframe snapping policy: auto, floor, ceil or nearest")
+	variantsPtr := streamFlag.String("variants", "", "ABR ladder as \"NAMEp:BITRATE,...\", e.g. \"1080p:5M,720p:2.8M,480p:1.4M\"")
+	formatPtr := streamFlag.String("format", "csv", "Marker file format: csv, youtube, edl, ffmetadata or fcpxml")
+
+	streamFlag.Parse(args)
+
+	if *csvPtr == "" {
+		subUsage("stream", streamFlag)
+		fmt.Printf("ERROR: No -csv file is provided\n")
+		os.Exit(1)
+	}
+
+	if *inputPtr == "" {
+		subUsage("stream", streamFlag)
+		fmt.Printf("ERROR: No -input file is provided\n")
+		os.Exit(1)
+	}
+
+	snapMode, err := parseSnapMode(*snapPtr)
+	if err != nil {
+		subUsage("stream", streamFlag)
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	variants, err := parseVariants(*variantsPtr)
+	if err != nil {
+		subUsage("stream", streamFlag)
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	chunks := loadChunksFromFile(*csvPtr, *delayPtr, *formatPtr, *inputPtr)
+	chunks = snapChunks(chunks, *inputPtr, snapMode)
+
+	for _, chunk := range chunks {
+		err := ffmpegCutChunk(*inputPtr, chunk, *yPtr, false, Encoder{Name: "copy"}, "", "", "")
+		if err != nil {
+			fmt.Printf("WARNING: Failed to cut chunk: %s\n", err)
+		}
+	}
+
+	if len(variants) == 0 {
+		for _, chunk := range chunks {
+			panic_if_err(ffmpegRemuxToSegment(chunk, nil, *yPtr))
+		}
+		panic_if_err(generateMediaPlaylist(chunks, "", "stream.m3u8"))
+	} else {
+		for _, variant := range variants {
+			v := variant
+			for _, chunk := range chunks {
+				panic_if_err(ffmpegRemuxToSegment(chunk, &v, *yPtr))
+			}
+			panic_if_err(generateMediaPlaylist(chunks, v.Name, fmt.Sprintf("%s.m3u8", v.Name)))
+		}
+		panic_if_err(generateMasterPlaylist(variants, "master.m3u8"))
+	}
+
+	panic_if_err(generateChaptersVTT(highlightChunks(chunks), "chapters.vtt"))
+
+	fmt.Println("Stream is rendered!")
+}
+
 func inspectSubcommand(args []string) {
 	inspectFlag := flag.NewFlagSet("inspect", flag.ExitOnError)
 	csvPtr := inspectFlag.String("csv", "", "Path to the CSV file with markers")
+	inputPtr := inspectFlag.String("input", "", "Path to the input video file (only needed for formats with an implicit last boundary)")
 	delayPtr := inspectFlag.Int("delay", 0, "Delay of markers in seconds")
+	formatPtr := inspectFlag.String("format", "csv", "Marker file format: csv, youtube, edl, ffmetadata or fcpxml")
 
 	inspectFlag.Parse(args)
 
@@ -296,7 +586,7 @@ func inspectSubcommand(args []string) {
 		os.Exit(1)
 	}
 
-	chunks := loadChunksFromFile(*csvPtr, *delayPtr)
+	chunks := loadChunksFromFile(*csvPtr, *delayPtr, *formatPtr, *inputPtr)
 	fmt.Println("Highlights:")
 	for _, highlight := range highlightChunks(chunks) {
 		fmt.Printf("%s - %s\n", highlight.timestamp, highlight.message)
@@ -317,6 +607,8 @@ func main() {
 		chunkSubcommand(os.Args[2:])
 	case "inspect":
 		inspectSubcommand(os.Args[2:])
+	case "stream":
+		streamSubcommand(os.Args[2:])
 	default:
 		usage()
 		fmt.Printf("Unknown subcommand %s\n", os.Args[1])
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultWorkerCount is the default value of the `-j` flag: half the
+// available cores, so ffmpeg's own internal threading still has room to
+// breathe, with a floor of 1 on single-core machines.
+func defaultWorkerCount() int {
+	n := runtime.NumCPU() / 2
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// ChunkJob is one unit of work handed to the cutting worker pool.
+type ChunkJob struct {
+	Index int
+	Chunk Chunk
+}
+
+// ChunkError records a chunk that failed to cut, collected by the worker
+// pool instead of being printed inline.
+type ChunkError struct {
+	Chunk Chunk
+	Err   error
+}
+
+// chunkProgress tracks how much of one chunk has been processed so far, in
+// milliseconds of output time, plus the last reported encoding speed.
+type chunkProgress struct {
+	outTimeMs int64
+	speed     string
+	done      bool
+}
+
+// ProgressRenderer aggregates per-chunk progress from concurrent workers
+// into a single `\r`-rewritten terminal line.
+type ProgressRenderer struct {
+	mu       sync.Mutex
+	progress map[int]*chunkProgress
+	total    int64 // total duration of all chunks, in milliseconds
+}
+
+func NewProgressRenderer(chunks []Chunk) *ProgressRenderer {
+	var total int64
+	progress := map[int]*chunkProgress{}
+	for i, chunk := range chunks {
+		total += int64(chunk.Duration(chunk.End)) * 1000
+		progress[i] = &chunkProgress{}
+	}
+
+	return &ProgressRenderer{progress: progress, total: total}
+}
+
+func (p *ProgressRenderer) update(index int, outTimeMs int64, speed string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cp := p.progress[index]
+	cp.outTimeMs = outTimeMs
+	cp.speed = speed
+	p.render()
+}
+
+func (p *ProgressRenderer) finish(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cp := p.progress[index]
+	cp.done = true
+	p.render()
+}
+
+// render must be called with p.mu held.
+func (p *ProgressRenderer) render() {
+	var processedMs int64
+	var speed string
+	for _, cp := range p.progress {
+		processedMs += cp.outTimeMs
+		if !cp.done && cp.outTimeMs > 0 {
+			speed = cp.speed
+		}
+	}
+
+	pct := 0.0
+	if p.total > 0 {
+		pct = float64(processedMs) / float64(p.total) * 100
+	}
+
+	fmt.Printf("\r\x1b[Kcutting: %.1f%% of %s, speed %s", pct, secsToTs(int(p.total/1000)), speed)
+}
+
+func (p *ProgressRenderer) Done() {
+	fmt.Printf("\n")
+}
+
+// parseFfmpegProgress reads the `-progress pipe:1` key=value stream from r
+// and invokes onProgress with the latest out_time_ms/speed values at the end
+// of each progress block (each "progress=" line).
+func parseFfmpegProgress(r io.Reader, onProgress func(outTimeMs int64, speed string)) {
+	var outTimeMs int64
+	var speed string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		comps := strings.SplitN(line, "=", 2)
+		if len(comps) != 2 {
+			continue
+		}
+
+		key := strings.TrimSpace(comps[0])
+		value := strings.TrimSpace(comps[1])
+
+		switch key {
+		case "out_time_ms":
+			// Despite the key's name, ffmpeg -progress reports this in
+			// microseconds, not milliseconds.
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil {
+				outTimeMs = us / 1000
+			}
+		case "speed":
+			speed = value
+		case "progress":
+			onProgress(outTimeMs, speed)
+		}
+	}
+}
+
+// ffmpegCutChunkProgress is like ffmpegCutChunk but reports progress via
+// onProgress as it runs, by parsing `-progress pipe:1 -nostats`. A chunk that
+// goes through ffmpegCutChunkHybrid reports no progress while it runs, only
+// its whole duration once it finishes.
+func ffmpegCutChunkProgress(inputPath string, chunk Chunk, y bool, reencode bool, encoder Encoder, crf string, preset string, bitrate string, onProgress func(outTimeMs int64, speed string)) error {
+	if reencode {
+		nextKeyframe := SnapToKeyframe(inputPath, chunk.Start, SnapCeil)
+		if nextKeyframe != chunk.Start {
+			err := ffmpegCutChunkHybrid(inputPath, chunk, nextKeyframe, y, encoder, crf, preset, bitrate)
+			onProgress(int64(chunk.Duration(chunk.End))*1000, "")
+			return err
+		}
+	}
+
+	args := []string{}
+	if y {
+		args = append(args, "-y")
+	}
+	args = append(args, encoder.InputArgs()...)
+	args = append(args, "-ss", strconv.Itoa(chunk.Start))
+	args = append(args, "-i", inputPath)
+	args = append(args, encoder.OutputArgs(crf, preset, bitrate)...)
+	args = append(args, "-t", strconv.Itoa(chunk.Duration(chunk.End)))
+	args = append(args, "-progress", "pipe:1", "-nostats")
+	args = append(args, chunk.Name)
+
+	cmd := exec.Command("ffmpeg", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	parseFfmpegProgress(stdout, onProgress)
+
+	return cmd.Wait()
+}
+
+// cutChunksParallel cuts chunks with a pool of workerCount goroutines,
+// reporting aggregate progress through renderer. It returns one ChunkError
+// per chunk that failed to cut.
+func cutChunksParallel(inputPath string, chunks []Chunk, y bool, reencode bool, encoder Encoder, crf string, preset string, bitrate string, workerCount int, renderer *ProgressRenderer) []ChunkError {
+	jobs := make(chan ChunkJob)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var chunkErrors []ChunkError
+
+	for w := 0; w < workerCount; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				err := ffmpegCutChunkProgress(inputPath, job.Chunk, y, reencode, encoder, crf, preset, bitrate, func(outTimeMs int64, speed string) {
+					renderer.update(job.Index, outTimeMs, speed)
+				})
+				renderer.finish(job.Index)
+				if err != nil {
+					mu.Lock()
+					chunkErrors = append(chunkErrors, ChunkError{Chunk: job.Chunk, Err: err})
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for i, chunk := range chunks {
+		jobs <- ChunkJob{Index: i, Chunk: chunk}
+	}
+	close(jobs)
+
+	wg.Wait()
+	renderer.Done()
+
+	return chunkErrors
+}